@@ -0,0 +1,106 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/cas/remote"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var pullCommand = cli.Command{
+	Name:  "pull",
+	Usage: "pulls an OCI image from a distribution registry",
+	ArgsUsage: `<registry-ref> --image <image-path>[:<tag>]
+
+Where "<registry-ref>" is the source registry reference of the form
+"<host>[:<port>]/<repository>[:<tag>]" (the tag defaults to "latest" if not
+given), and "<image-path>" is the path to the OCI image to create or update.
+
+umoci pull resolves "<registry-ref>"'s tag to a manifest (or manifest list),
+then recursively downloads every blob reachable from it that is not already
+present in "<image-path>", before writing the local tag.`,
+
+	Category: "image",
+
+	Action: pull,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <registry-ref>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("registry-ref cannot be empty")
+		}
+		ctx.App.Metadata["registry-ref"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func pull(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	registryRef := ctx.App.Metadata["registry-ref"].(string)
+
+	// Split the optional ":<tag>" off "<host>[:<port>]/<repository>[:<tag>]".
+	// A colon before the last "/" belongs to the port, not to a tag.
+	repositoryRef, remoteTag := registryRef, "latest"
+	if i := strings.LastIndex(registryRef, ":"); i > strings.LastIndex(registryRef, "/") {
+		repositoryRef, remoteTag = registryRef[:i], registryRef[i+1:]
+	}
+
+	remoteEngine, err := remote.Open(repositoryRef)
+	if err != nil {
+		return errors.Wrap(err, "open registry")
+	}
+	defer remoteEngine.Close()
+
+	if err := dir.Create(imagePath); err != nil && !os.IsExist(errors.Cause(err)) {
+		return errors.Wrap(err, "create image layout")
+	}
+
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	log.Infof("pulling %s:%s from %s", imagePath, tagName, registryRef)
+
+	descriptor, err := remoteEngine.GetReference(context.Background(), remoteTag)
+	if err != nil {
+		return errors.Wrap(err, "resolve tag")
+	}
+
+	if err := pushDescriptor(context.Background(), remoteEngine, engine, descriptor); err != nil {
+		return errors.Wrap(err, "pull image")
+	}
+
+	if err := engine.PutReference(context.Background(), tagName, descriptor); err != nil {
+		return errors.Wrap(err, "write local tag")
+	}
+
+	log.Infof("pulled tag %s from %s", tagName, registryRef)
+	return nil
+}
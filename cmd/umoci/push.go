@@ -0,0 +1,258 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/cas/remote"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var pushCommand = cli.Command{
+	Name:  "push",
+	Usage: "pushes an OCI image to a distribution registry",
+	ArgsUsage: `--image <image-path>[:<tag>] <registry-ref>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the tag to
+push (defaults to "latest"), and "<registry-ref>" is the destination
+registry reference of the form "<host>[:<port>]/<repository>".
+
+umoci push walks every blob reachable from the tagged manifest (or manifest
+list) and uploads any the registry does not already have, before finally
+pushing the manifest itself.`,
+
+	Category: "image",
+
+	Action: push,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <registry-ref>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("registry-ref cannot be empty")
+		}
+		ctx.App.Metadata["registry-ref"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func push(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	registryRef := ctx.App.Metadata["registry-ref"].(string)
+
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	remoteEngine, err := remote.Open(registryRef)
+	if err != nil {
+		return errors.Wrap(err, "open registry")
+	}
+	defer remoteEngine.Close()
+
+	descriptor, err := engine.GetReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "resolve tag")
+	}
+
+	log.Infof("pushing %s:%s to %s", imagePath, tagName, registryRef)
+
+	if err := pushDescriptor(context.Background(), engine, remoteEngine, descriptor); err != nil {
+		return errors.Wrap(err, "push image")
+	}
+
+	if err := remoteEngine.PutReference(context.Background(), tagName, descriptor); err != nil {
+		return errors.Wrap(err, "push tag")
+	}
+
+	log.Infof("pushed tag %s to %s", tagName, registryRef)
+	return nil
+}
+
+// manifestGetter is implemented by cas.Engine backends (such as
+// *remote.Engine) that cannot serve manifest content through GetBlob,
+// because their backing store keeps manifests separate from ordinary blobs.
+// getManifestBlob uses it to fetch manifest/index content the right way
+// regardless of which kind of engine src turns out to be.
+type manifestGetter interface {
+	GetManifest(ctx context.Context, digest digest.Digest) (io.ReadCloser, error)
+}
+
+// getManifestBlob fetches the raw manifest or index content named by digest
+// from src. A registry never serves manifest content from the blobs
+// endpoint -- only from /v2/<name>/manifests/<digest> -- so this prefers
+// src's GetManifest when available (see manifestGetter) and only falls back
+// to GetBlob for engines (such as the dir engine) that store manifests as
+// ordinary content-addressed blobs.
+func getManifestBlob(ctx context.Context, src cas.Engine, digest digest.Digest) (io.ReadCloser, error) {
+	if mg, ok := src.(manifestGetter); ok {
+		return mg.GetManifest(ctx, digest)
+	}
+	return src.GetBlob(ctx, digest)
+}
+
+// pushDescriptor recursively copies the content named by descriptor (and,
+// for manifests and manifest lists, every blob it references) from src to
+// dst, skipping any blob already present at dst. Manifests and indexes are
+// not copied with copyBlob alone: a registry only accepts an index's child
+// manifests as valid manifests -- rather than opaque blobs -- if they were
+// themselves registered via a manifest PUT, so those media types are pushed
+// with pushManifest, which follows the blob upload with that manifest PUT.
+func pushDescriptor(ctx context.Context, src cas.Engine, dst cas.Engine, descriptor ispec.Descriptor) error {
+	switch descriptor.MediaType {
+	case ispec.MediaTypeImageManifest:
+		rdr, err := getManifestBlob(ctx, src, descriptor.Digest)
+		if err != nil {
+			return errors.Wrap(err, "get manifest")
+		}
+		defer rdr.Close()
+
+		var manifest ispec.Manifest
+		if err := json.NewDecoder(rdr).Decode(&manifest); err != nil {
+			return errors.Wrap(err, "decode manifest")
+		}
+
+		if err := pushDescriptor(ctx, src, dst, manifest.Config); err != nil {
+			return errors.Wrap(err, "push config")
+		}
+		for _, layer := range manifest.Layers {
+			if err := pushDescriptor(ctx, src, dst, layer); err != nil {
+				return errors.Wrap(err, "push layer")
+			}
+		}
+
+		if err := pushManifest(ctx, src, dst, descriptor); err != nil {
+			return errors.Wrap(err, "push manifest")
+		}
+
+	case ispec.MediaTypeImageIndex:
+		rdr, err := getManifestBlob(ctx, src, descriptor.Digest)
+		if err != nil {
+			return errors.Wrap(err, "get index")
+		}
+		defer rdr.Close()
+
+		var index ispec.Index
+		if err := json.NewDecoder(rdr).Decode(&index); err != nil {
+			return errors.Wrap(err, "decode index")
+		}
+
+		for _, manifest := range index.Manifests {
+			if err := pushDescriptor(ctx, src, dst, manifest); err != nil {
+				return errors.Wrap(err, "push child manifest")
+			}
+		}
+
+		if err := pushManifest(ctx, src, dst, descriptor); err != nil {
+			return errors.Wrap(err, "push index")
+		}
+
+	default:
+		if err := copyBlob(ctx, src, dst, descriptor.Digest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pushManifest registers the manifest or index content named by descriptor
+// at dst, addressed by its own digest. The content must first exist in
+// dst's blob store (PutReference's contract, mirroring how every other
+// cas.Engine caller attaches a reference on top of an already-stored blob),
+// so this still uploads the content once before the manifest PUT -- but,
+// unlike the blob-upload session alone, the manifest PUT is what makes a
+// parent index's reference to this digest resolvable. The content is read
+// from src via getManifestBlob rather than copyBlob's GetBlob, for the same
+// reason pushDescriptor does: a registry never serves manifest content from
+// the blobs endpoint.
+func pushManifest(ctx context.Context, src cas.Engine, dst cas.Engine, descriptor ispec.Descriptor) error {
+	if rdr, err := dst.GetBlob(ctx, descriptor.Digest); err == nil {
+		rdr.Close()
+		log.Debugf("blob %s already present, skipping", descriptor.Digest)
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return errors.Wrap(err, "check for existing blob")
+	} else {
+		rdr, err := getManifestBlob(ctx, src, descriptor.Digest)
+		if err != nil {
+			return errors.Wrap(err, "get manifest")
+		}
+		defer rdr.Close()
+
+		if err := putBlobAs(ctx, dst, descriptor.Digest, rdr); err != nil {
+			return err
+		}
+	}
+	return dst.PutReference(ctx, descriptor.Digest.String(), descriptor)
+}
+
+// copyBlob copies a single blob from src to dst, unless dst already has a
+// blob stored at that digest.
+func copyBlob(ctx context.Context, src cas.Engine, dst cas.Engine, digest digest.Digest) error {
+	if rdr, err := dst.GetBlob(ctx, digest); err == nil {
+		rdr.Close()
+		log.Debugf("blob %s already present, skipping", digest)
+		return nil
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return errors.Wrap(err, "check for existing blob")
+	}
+
+	rdr, err := src.GetBlob(ctx, digest)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer rdr.Close()
+
+	return putBlobAs(ctx, dst, digest, rdr)
+}
+
+// putBlobAs reads content from rdr and stores it at dst, verifying that the
+// digest dst reports back matches the expected digest.
+func putBlobAs(ctx context.Context, dst cas.Engine, digest digest.Digest, rdr io.Reader) error {
+	buf, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return errors.Wrap(err, "read blob")
+	}
+
+	newDigest, _, err := dst.PutBlob(ctx, bytes.NewReader(buf))
+	if err != nil {
+		return errors.Wrap(err, "put blob")
+	}
+	if newDigest != digest {
+		return errors.Errorf("digest mismatch copying blob: expected %s got %s", digest, newDigest)
+	}
+
+	log.Debugf("pushed blob %s", digest)
+	return nil
+}
@@ -19,6 +19,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -26,12 +27,15 @@ import (
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/encryption"
 	"github.com/openSUSE/umoci/pkg/fseval"
 	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -79,6 +83,28 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			Name:  "refresh-bundle",
 			Usage: "update the bundle metadata (mtree) to reflect the packed rootfs",
 		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform (os/arch[/variant]) of the manifest to repack, if --image points to an image index",
+		},
+		cli.StringFlag{
+			Name:  "digest-algorithm",
+			Usage: "digest algorithm used to address new blobs (sha256 or sha512)",
+			Value: cas.DefaultBlobAlgorithm.String(),
+		},
+		cli.BoolFlag{
+			Name:  "encrypt-layer",
+			Usage: "encrypt the new diff layer, wrapping the data key to each --recipient",
+		},
+		cli.StringSliceFlag{
+			Name:  "recipient",
+			Usage: "path to a recipient's PEM-encoded public key to encrypt the new layer to (requires --encrypt-layer)",
+		},
+		cli.StringFlag{
+			Name:  "compress",
+			Usage: "compression codec for the new diff layer (gzip, zstd, or none)",
+			Value: string(layer.GzipCompression),
+		},
 	},
 
 	Action: repack,
@@ -95,6 +121,38 @@ manifest and configuration information uses the new diff atop the old manifest.`
 	},
 })
 
+// parsePlatform parses a platform specifier of the form "os/arch" or
+// "os/arch/variant", as used by the --platform flag.
+func parsePlatform(s string) (ispec.Platform, error) {
+	parts := strings.SplitN(s, "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return ispec.Platform{}, errors.Errorf("invalid platform %q: expected os/arch[/variant]", s)
+	}
+	platform := ispec.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+// loadRecipients reads each --recipient path as a PEM-encoded public key,
+// returning one encryption.Recipient per path.
+func loadRecipients(paths []string) ([]encryption.Recipient, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("--encrypt-layer requires at least one --recipient")
+	}
+
+	recipients := make([]encryption.Recipient, 0, len(paths))
+	for _, path := range paths {
+		key, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read recipient key %q", path)
+		}
+		recipients = append(recipients, encryption.Recipient{Name: path, PublicKey: key})
+	}
+	return recipients, nil
+}
+
 func repack(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	tagName := ctx.App.Metadata["--image-tag"].(string)
@@ -112,12 +170,31 @@ func repack(ctx *cli.Context) error {
 		"map_options": meta.MapOptions,
 	}).Debugf("umoci: loaded UmociMeta metadata")
 
-	if meta.From.Descriptor().MediaType != ispec.MediaTypeImageManifest {
-		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", meta.From.Descriptor().MediaType), "invalid saved from descriptor")
+	var platform *ispec.Platform
+	switch meta.From.Descriptor().MediaType {
+	case ispec.MediaTypeImageManifest:
+		// Nothing to do -- there's only one manifest to repack.
+	case ispec.MediaTypeImageIndex:
+		platformString := ctx.String("platform")
+		if platformString == "" {
+			return errors.Errorf("--image points to an image index: --platform must be specified to select which manifest to repack")
+		}
+		parsed, err := parsePlatform(platformString)
+		if err != nil {
+			return errors.Wrap(err, "parse --platform")
+		}
+		platform = &parsed
+	default:
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest or ispec.MediaTypeImageIndex: not implemented: %s", meta.From.Descriptor().MediaType), "invalid saved from descriptor")
+	}
+
+	algorithm := digest.Algorithm(ctx.String("digest-algorithm"))
+	if !cas.IsBlobAlgorithm(algorithm) {
+		return errors.Errorf("unsupported --digest-algorithm %q", algorithm)
 	}
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := dir.Open(imagePath, dir.WithAlgorithm(algorithm))
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -125,7 +202,7 @@ func repack(ctx *cli.Context) error {
 	defer engine.Close()
 
 	// Create the mutator.
-	mutator, err := mutate.New(engine, meta.From)
+	mutator, err := mutate.New(engine, meta.From, platform)
 	if err != nil {
 		return errors.Wrap(err, "create mutator for base image")
 	}
@@ -222,10 +299,28 @@ func repack(ctx *cli.Context) error {
 		history.CreatedBy = val.(string)
 	}
 
+	compression := layer.Compression(ctx.String("compress"))
+	if _, err := compression.MediaType(); err != nil {
+		return errors.Wrap(err, "parse --compress")
+	}
+
 	// TODO: We should add a flag to allow for a new layer to be made
 	//       non-distributable.
-	if err := mutator.Add(context.Background(), reader, history); err != nil {
-		return errors.Wrap(err, "add diff layer")
+	if ctx.Bool("encrypt-layer") {
+		recipients, err := loadRecipients(ctx.StringSlice("recipient"))
+		if err != nil {
+			return errors.Wrap(err, "load --recipient keys")
+		}
+		if err := mutator.AddEncrypted(context.Background(), reader, history, compression, recipients); err != nil {
+			return errors.Wrap(err, "add encrypted diff layer")
+		}
+	} else {
+		if len(ctx.StringSlice("recipient")) > 0 {
+			return errors.New("--recipient was given without --encrypt-layer")
+		}
+		if err := mutator.Add(context.Background(), reader, history, compression); err != nil {
+			return errors.Wrap(err, "add diff layer")
+		}
 	}
 
 	newDescriptorPath, err := mutator.Commit(context.Background())
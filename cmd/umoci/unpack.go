@@ -0,0 +1,146 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/encryption"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var unpackCommand = cli.Command{
+	Name:  "unpack",
+	Usage: "unpacks an OCI image into an OCI runtime bundle",
+	ArgsUsage: `--image <image-path>[:<tag>] <bundle>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of
+the tagged manifest to unpack (defaults to "latest"), and "<bundle>" is the
+destination the image's layers are unpacked into, in order. No runtime
+config or bundle metadata is generated.`,
+
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "key",
+			Usage: "path to the PEM-encoded private key used to decrypt any encrypted layers",
+		},
+	},
+
+	Action: unpack,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <bundle>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("bundle path cannot be empty")
+		}
+		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func unpack(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	bundlePath := ctx.App.Metadata["bundle"].(string)
+
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	descriptor, err := engine.GetReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get tag")
+	}
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Errorf("descriptor does not point to %s: not implemented: %s", ispec.MediaTypeImageManifest, descriptor.MediaType)
+	}
+
+	manifestBlob, err := engine.GetBlob(context.Background(), descriptor.Digest)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	var manifest ispec.Manifest
+	err = json.NewDecoder(manifestBlob).Decode(&manifest)
+	manifestBlob.Close()
+	if err != nil {
+		return errors.Wrap(err, "decode manifest")
+	}
+
+	var privateKey []byte
+	if keyPath := ctx.String("key"); keyPath != "" {
+		privateKey, err = ioutil.ReadFile(keyPath)
+		if err != nil {
+			return errors.Wrap(err, "read --key")
+		}
+	}
+
+	log.Infof("unpacking %s:%s to %s", imagePath, tagName, bundlePath)
+
+	for _, layerDescriptor := range manifest.Layers {
+		reader, err := engine.GetBlob(context.Background(), layerDescriptor.Digest)
+		if err != nil {
+			return errors.Wrap(err, "get layer blob")
+		}
+
+		mediaType := layerDescriptor.MediaType
+		var compressed io.Reader = reader
+		if strings.HasSuffix(mediaType, "+encrypted") {
+			if privateKey == nil {
+				reader.Close()
+				return errors.Errorf("layer %s is encrypted: --key is required to unpack it", layerDescriptor.Digest)
+			}
+			compressed, err = encryption.DecryptLayer(reader, layerDescriptor.Annotations, privateKey)
+			if err != nil {
+				reader.Close()
+				return errors.Wrapf(err, "decrypt layer %s", layerDescriptor.Digest)
+			}
+		}
+
+		uncompressed, err := layer.Decompress(mediaType, compressed)
+		if err != nil {
+			reader.Close()
+			return errors.Wrapf(err, "decompress layer %s", layerDescriptor.Digest)
+		}
+
+		err = layer.UnpackLayer(bundlePath, uncompressed, fseval.DefaultFsEval)
+		uncompressed.Close()
+		reader.Close()
+		if err != nil {
+			return errors.Wrapf(err, "unpack layer %s", layerDescriptor.Digest)
+		}
+	}
+
+	log.Infof("... done")
+	return nil
+}
@@ -0,0 +1,349 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mutate implements a Mutator, which takes a descriptor path from an
+// existing OCI image and allows the caller to incrementally build up a set
+// of changes (new layers, new history, a new config) before committing a new
+// descriptor back to the image's CAS.
+package mutate
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/encryption"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Meta is a subset of ispec.Image and ispec.Manifest that is exposed to
+// callers of Mutator so that they don't need to re-parse the blobs
+// themselves.
+type Meta struct {
+	// Author is the author field taken from the manifest's image config.
+	Author string
+
+	// Platform is the platform of the manifest being mutated (either taken
+	// from the selecting --platform flag, or derived from the image config
+	// if the original descriptor was already a single manifest).
+	Platform ispec.Platform
+}
+
+// Mutator is a wrapper around a cas.Engine instance, which takes an existing
+// descriptor (usually pointing to an ispec.MediaTypeImageManifest, but also
+// an ispec.MediaTypeImageIndex if a Platform was given to New) and allows
+// the caller to add new layers and history entries, before Commit()ing the
+// result as a new descriptor.
+//
+// If the original descriptor pointed to an image index, Commit() will
+// re-emit an index with the mutated manifest swapped in for its matching
+// platform entry, while every other platform's descriptor is preserved
+// byte-for-byte.
+type Mutator struct {
+	engine cas.Engine
+	from   casext.DescriptorPath
+
+	// index is non-nil if the original descriptor pointed to an image
+	// index; it is the parsed index, retained so that Commit() can
+	// preserve every entry other than the one being mutated.
+	index *ispec.Index
+
+	// platform is the platform that was selected out of index, if index
+	// is non-nil.
+	platform *ispec.Platform
+
+	manifest ispec.Manifest
+	config   ispec.Image
+
+	// manifestDigest is the digest of the (possibly index-nested)
+	// manifest that is being mutated.
+	manifestDigest digest.Digest
+}
+
+// New creates a new Mutator for the descriptor at from.
+//
+// If from points to an ispec.MediaTypeImageIndex, platform must be non-nil
+// and must match exactly one of the index's Manifests (matched against each
+// entry's Descriptor.Platform) -- otherwise New returns an error. If from
+// already points to an ispec.MediaTypeImageManifest, platform is ignored.
+func New(engine cas.Engine, from casext.DescriptorPath, platform *ispec.Platform) (*Mutator, error) {
+	ctx := context.Background()
+
+	descriptor := from.Descriptor()
+	manifestDescriptor := descriptor
+
+	var index *ispec.Index
+	switch descriptor.MediaType {
+	case ispec.MediaTypeImageManifest:
+		// Nothing to select -- there is only one manifest, so platform is
+		// ignored.
+		platform = nil
+
+	case ispec.MediaTypeImageIndex:
+		if platform == nil {
+			return nil, errors.New("descriptor is an image index: a --platform must be specified to select a manifest to mutate")
+		}
+
+		idx, err := parseIndex(ctx, engine, descriptor.Digest)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse image index")
+		}
+		index = idx
+
+		selected, err := selectPlatform(index.Manifests, *platform)
+		if err != nil {
+			return nil, err
+		}
+		manifestDescriptor = selected
+
+	default:
+		return nil, errors.Errorf("descriptor does not point to %s or %s: not implemented: %s", ispec.MediaTypeImageManifest, ispec.MediaTypeImageIndex, descriptor.MediaType)
+	}
+
+	manifest, err := parseManifest(ctx, engine, manifestDescriptor.Digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse manifest")
+	}
+
+	config, err := parseConfig(ctx, engine, manifest.Config.Digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse config")
+	}
+
+	return &Mutator{
+		engine:         engine,
+		from:           from,
+		index:          index,
+		platform:       platform,
+		manifest:       manifest,
+		config:         config,
+		manifestDigest: manifestDescriptor.Digest,
+	}, nil
+}
+
+// Config returns the current (mutated) image configuration.
+func (m *Mutator) Config(ctx context.Context) (ispec.ImageConfig, error) {
+	return m.config.Config, nil
+}
+
+// Meta returns a small set of image-level metadata, primarily used to
+// default history entries added via Add().
+func (m *Mutator) Meta(ctx context.Context) (Meta, error) {
+	meta := Meta{Author: m.config.Author}
+	if m.platform != nil {
+		meta.Platform = *m.platform
+	} else {
+		meta.Platform = ispec.Platform{Architecture: m.config.Architecture, OS: m.config.OS}
+	}
+	return meta, nil
+}
+
+// Add adds a new layer (read from reader, which must be an uncompressed tar
+// stream) to the image, compressing it with the given codec, along with the
+// given history entry.
+func (m *Mutator) Add(ctx context.Context, reader io.Reader, history ispec.History, compression layer.Compression) error {
+	return m.addLayer(ctx, reader, history, compression, nil)
+}
+
+// AddEncrypted behaves like Add, except that the compressed layer is
+// additionally encrypted (see pkg/encryption) to every given recipient
+// before being stored, and the resulting descriptor's mediatype and
+// annotations record that it is encrypted and how to decrypt it.
+func (m *Mutator) AddEncrypted(ctx context.Context, reader io.Reader, history ispec.History, compression layer.Compression, recipients []encryption.Recipient) error {
+	return m.addLayer(ctx, reader, history, compression, recipients)
+}
+
+// addLayer is the shared implementation behind Add and AddEncrypted. The
+// DiffID recorded in the image config is always computed over the
+// uncompressed tar stream read from reader, regardless of compression or
+// encryption -- only the blob stored in the CAS (and its descriptor's
+// mediatype) is affected by those.
+func (m *Mutator) addLayer(ctx context.Context, reader io.Reader, history ispec.History, compression layer.Compression, recipients []encryption.Recipient) error {
+	mediaType, err := compression.MediaType()
+	if err != nil {
+		return errors.Wrap(err, "determine layer mediatype")
+	}
+
+	diffIDDigester := digest.Canonical.Digester()
+	blob, err := compression.Compress(io.TeeReader(reader, diffIDDigester.Hash()))
+	if err != nil {
+		return errors.Wrap(err, "compress layer")
+	}
+
+	var annotations map[string]string
+	if len(recipients) > 0 {
+		ciphertext, encAnnotations, err := encryption.EncryptLayer(blob, recipients)
+		if err != nil {
+			return errors.Wrap(err, "encrypt layer")
+		}
+		blob = ciphertext
+		annotations = encAnnotations
+		mediaType += "+encrypted"
+	}
+
+	blobDigest, size, err := m.engine.PutBlob(ctx, blob)
+	if err != nil {
+		return errors.Wrap(err, "put layer blob")
+	}
+
+	m.manifest.Layers = append(m.manifest.Layers, ispec.Descriptor{
+		MediaType:   mediaType,
+		Digest:      blobDigest,
+		Size:        size,
+		Annotations: annotations,
+	})
+	// The DiffID is only complete once blob (which reads from the tee'd
+	// reader) has been fully consumed, which PutBlob above guarantees.
+	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs, diffIDDigester.Digest())
+	m.config.History = append(m.config.History, history)
+
+	return nil
+}
+
+// Commit writes the mutated config and manifest as new blobs, then -- if the
+// original descriptor pointed to an image index -- re-emits the index with
+// the new manifest swapped in for the platform that was selected by New,
+// leaving every other platform's descriptor untouched. It returns the
+// descriptor path of the newly created (possibly index-rooted) image.
+func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
+	configDigest, configSize, err := m.engine.PutBlobJSON(ctx, m.config)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "put config blob")
+	}
+	m.manifest.Config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+
+	manifestDigest, manifestSize, err := m.engine.PutBlobJSON(ctx, m.manifest)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "put manifest blob")
+	}
+	manifestDescriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+	if m.platform != nil {
+		manifestDescriptor.Platform = m.platform
+	}
+
+	if m.index == nil {
+		return m.from.Append(manifestDescriptor), nil
+	}
+
+	newIndex := ispec.Index{
+		Versioned:   m.index.Versioned,
+		MediaType:   m.index.MediaType,
+		Annotations: m.index.Annotations,
+		Manifests:   make([]ispec.Descriptor, len(m.index.Manifests)),
+	}
+	for i, old := range m.index.Manifests {
+		if old.Digest == m.manifestDigest {
+			newIndex.Manifests[i] = manifestDescriptor
+			continue
+		}
+		// Unrelated platforms are preserved byte-for-byte (the original
+		// descriptor, digest and all, is kept as-is).
+		newIndex.Manifests[i] = old
+	}
+
+	indexDigest, indexSize, err := m.engine.PutBlobJSON(ctx, newIndex)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "put index blob")
+	}
+
+	return m.from.Append(ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}), nil
+}
+
+// selectPlatform finds the single entry in manifests whose Descriptor.Platform
+// matches the requested platform exactly on OS and Architecture (Variant, if
+// given, must also match).
+func selectPlatform(manifests []ispec.Descriptor, platform ispec.Platform) (ispec.Descriptor, error) {
+	var selected *ispec.Descriptor
+	for i, manifest := range manifests {
+		if manifest.Platform == nil {
+			continue
+		}
+		if manifest.Platform.OS != platform.OS || manifest.Platform.Architecture != platform.Architecture {
+			continue
+		}
+		if platform.Variant != "" && manifest.Platform.Variant != platform.Variant {
+			continue
+		}
+		if selected != nil {
+			return ispec.Descriptor{}, errors.Errorf("more than one manifest in index matches platform %s/%s", platform.OS, platform.Architecture)
+		}
+		selected = &manifests[i]
+	}
+	if selected == nil {
+		return ispec.Descriptor{}, errors.Errorf("no manifest in index matches platform %s/%s", platform.OS, platform.Architecture)
+	}
+	return *selected, nil
+}
+
+func parseIndex(ctx context.Context, engine cas.Engine, digest digest.Digest) (*ispec.Index, error) {
+	reader, err := engine.GetBlob(ctx, digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "get index blob")
+	}
+	defer reader.Close()
+
+	var index ispec.Index
+	if err := json.NewDecoder(reader).Decode(&index); err != nil {
+		return nil, errors.Wrap(err, "decode index")
+	}
+	return &index, nil
+}
+
+func parseManifest(ctx context.Context, engine cas.Engine, digest digest.Digest) (ispec.Manifest, error) {
+	reader, err := engine.GetBlob(ctx, digest)
+	if err != nil {
+		return ispec.Manifest{}, errors.Wrap(err, "get manifest blob")
+	}
+	defer reader.Close()
+
+	var manifest ispec.Manifest
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return ispec.Manifest{}, errors.Wrap(err, "decode manifest")
+	}
+	return manifest, nil
+}
+
+func parseConfig(ctx context.Context, engine cas.Engine, digest digest.Digest) (ispec.Image, error) {
+	reader, err := engine.GetBlob(ctx, digest)
+	if err != nil {
+		return ispec.Image{}, errors.Wrap(err, "get config blob")
+	}
+	defer reader.Close()
+
+	var config ispec.Image
+	if err := json.NewDecoder(reader).Decode(&config); err != nil {
+		return ispec.Image{}, errors.Wrap(err, "decode config")
+	}
+	return config, nil
+}
@@ -0,0 +1,57 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestSelectPlatform(t *testing.T) {
+	manifests := []ispec.Descriptor{
+		{Digest: "sha256:amd64", Platform: &ispec.Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "sha256:arm64v8", Platform: &ispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{Digest: "sha256:nomatch", Platform: &ispec.Platform{OS: "windows", Architecture: "amd64"}},
+		{Digest: "sha256:noplatform"},
+	}
+
+	selected, err := selectPlatform(manifests, ispec.Platform{OS: "linux", Architecture: "amd64"})
+	if err != nil {
+		t.Fatalf("selectPlatform: %v", err)
+	}
+	if selected.Digest != "sha256:amd64" {
+		t.Fatalf("selected wrong manifest: got %s", selected.Digest)
+	}
+
+	selected, err = selectPlatform(manifests, ispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"})
+	if err != nil {
+		t.Fatalf("selectPlatform with variant: %v", err)
+	}
+	if selected.Digest != "sha256:arm64v8" {
+		t.Fatalf("selected wrong manifest: got %s", selected.Digest)
+	}
+
+	if _, err := selectPlatform(manifests, ispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v7"}); err == nil {
+		t.Fatalf("selectPlatform unexpectedly matched a variant that isn't present")
+	}
+
+	if _, err := selectPlatform(manifests, ispec.Platform{OS: "darwin", Architecture: "amd64"}); err == nil {
+		t.Fatalf("selectPlatform unexpectedly matched a platform that isn't present")
+	}
+}
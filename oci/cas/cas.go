@@ -21,21 +21,44 @@ import (
 	"fmt"
 	"io"
 
-	// We need to include sha256 in order for go-digest to properly handle such
-	// hashes, since Go's crypto library like to lazy-load cryptographic
-	// libraries.
+	// We need to include sha256 and sha512 in order for go-digest to
+	// properly handle such hashes, since Go's crypto library likes to
+	// lazy-load cryptographic libraries.
 	_ "crypto/sha256"
+	_ "crypto/sha512"
 
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/net/context"
 )
 
-const (
-	// BlobAlgorithm is the name of the only supported digest algorithm for blobs.
-	// FIXME: We can make this a list.
-	BlobAlgorithm = digest.SHA256
-)
+// BlobAlgorithms is the set of digest algorithms that a cas.Engine must
+// accept for blobs it already has stored. The OCI image-spec requires
+// sha256 support and permits others (such as sha512) to also be used, so an
+// Engine implementation MUST transparently read blobs addressed by any
+// algorithm in this list, regardless of which algorithm was used to write
+// them.
+var BlobAlgorithms = []digest.Algorithm{
+	digest.SHA256,
+	digest.SHA512,
+}
+
+// DefaultBlobAlgorithm is the digest algorithm that PutBlob and PutBlobJSON
+// use to address newly written blobs, unless the Engine was explicitly
+// configured (for instance through --digest-algorithm) to use a different
+// member of BlobAlgorithms.
+const DefaultBlobAlgorithm = digest.SHA256
+
+// IsBlobAlgorithm returns whether algo is one of the digest algorithms in
+// BlobAlgorithms.
+func IsBlobAlgorithm(algo digest.Algorithm) bool {
+	for _, candidate := range BlobAlgorithms {
+		if algo == candidate {
+			return true
+		}
+	}
+	return false
+}
 
 // Exposed errors.
 var (
@@ -59,21 +82,20 @@ var (
 // Engine is an interface that provides methods for accessing and modifying an
 // OCI image, namely allowing access to reference descriptors and blobs.
 type Engine interface {
-	// PutBlob adds a new blob to the image. This is idempotent; a nil error
-	// means that "the content is stored at DIGEST" without implying "because
-	// of this PutBlob() call".
+	// PutBlob adds a new blob to the image, addressed using the Engine's
+	// configured digest algorithm (one of BlobAlgorithms). This is
+	// idempotent; a nil error means that "the content is stored at DIGEST"
+	// without implying "because of this PutBlob() call".
 	PutBlob(ctx context.Context, reader io.Reader) (digest digest.Digest, size int64, err error)
 
-	// PutBlobJSON adds a new JSON blob to the image (marshalled from the given
-	// interface). This is equivalent to calling PutBlob() with a JSON payload
-	// as the reader. Note that due to intricacies in the Go JSON
-	// implementation, we cannot guarantee that two calls to PutBlobJSON() will
-	// return the same digest.
-	//
-	// TODO: Use a proper JSON serialisation library, which actually guarantees
-	//       consistent output. Go's JSON library doesn't even attempt to sort
-	//       map[...]... objects (which have their iteration order randomised
-	//       in Go).
+	// PutBlobJSON adds a new JSON blob to the image (marshalled from the
+	// given interface), addressed using the same digest algorithm as
+	// PutBlob(). This is equivalent to calling PutBlob() with a JSON
+	// payload as the reader, except that the payload is serialised with
+	// pkg/cjson rather than encoding/json directly, so that two calls with
+	// logically equal input are guaranteed to produce the same digest (Go's
+	// encoding/json does not sort map[...]... keys, whose iteration order is
+	// randomised).
 	PutBlobJSON(ctx context.Context, data interface{}) (digest digest.Digest, size int64, err error)
 
 	// PutReference adds a new reference descriptor blob to the image. This is
@@ -84,14 +106,17 @@ type Engine interface {
 	PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) (err error)
 
 	// GetBlob returns a reader for retrieving a blob from the image, which the
-	// caller must Close(). Returns os.ErrNotExist if the digest is not found.
+	// caller must Close(). The digest may use any algorithm in
+	// BlobAlgorithms, regardless of which algorithm was used to write it.
+	// Returns os.ErrNotExist if the digest is not found.
 	GetBlob(ctx context.Context, digest digest.Digest) (reader io.ReadCloser, err error)
 
 	// GetReference returns a reference from the image. Returns os.ErrNotExist
 	// if the name was not found.
 	GetReference(ctx context.Context, name string) (descriptor ispec.Descriptor, err error)
 
-	// DeleteBlob removes a blob from the image. This is idempotent; a nil
+	// DeleteBlob removes a blob from the image, regardless of which of
+	// BlobAlgorithms was used to address it. This is idempotent; a nil
 	// error means "the content is not in the store" without implying "because
 	// of this DeleteBlob() call".
 	DeleteBlob(ctx context.Context, digest digest.Digest) (err error)
@@ -101,7 +126,9 @@ type Engine interface {
 	// "because of this DeleteReference() call".
 	DeleteReference(ctx context.Context, name string) (err error)
 
-	// ListBlobs returns the set of blob digests stored in the image.
+	// ListBlobs returns the set of blob digests stored in the image, which
+	// may be addressed using any mixture of the algorithms in
+	// BlobAlgorithms.
 	ListBlobs(ctx context.Context) (digests []digest.Digest, err error)
 
 	// ListReferences returns the set of reference names stored in the image.
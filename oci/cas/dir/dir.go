@@ -0,0 +1,265 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package dir implements a cas.Engine backed by a local OCI image layout
+// directory, as described by the OCI Image Format specification: an
+// oci-layout marker, a blobs/<algo>/<hex> tree addressed by digest, and (as
+// a umoci-specific extension used to implement PutReference/GetReference by
+// an arbitrary name) a refs/ directory of named descriptor blobs.
+package dir
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/cjson"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	blobsDir   = "blobs"
+	refsDir    = "refs"
+	layoutFile = "oci-layout"
+)
+
+// Engine is a cas.Engine backed by a local OCI image layout directory.
+type Engine struct {
+	path      string
+	algorithm digest.Algorithm
+}
+
+// Option configures an optional behaviour of an Engine returned by Open.
+type Option func(*Engine)
+
+// WithAlgorithm sets the digest algorithm (one of cas.BlobAlgorithms) used
+// to address new blobs written through PutBlob and PutBlobJSON. If not
+// given, Open defaults to cas.DefaultBlobAlgorithm. Blobs addressed with any
+// other algorithm in cas.BlobAlgorithms continue to be read, deleted and
+// listed transparently, regardless of this setting.
+func WithAlgorithm(algorithm digest.Algorithm) Option {
+	return func(e *Engine) { e.algorithm = algorithm }
+}
+
+// Create initialises a new, empty OCI image layout at path.
+func Create(path string) error {
+	if err := os.Mkdir(path, 0755); err != nil {
+		return errors.Wrap(err, "mkdir image path")
+	}
+	for _, algo := range cas.BlobAlgorithms {
+		if err := os.MkdirAll(filepath.Join(path, blobsDir, algo.String()), 0755); err != nil {
+			return errors.Wrap(err, "mkdir blobs")
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(path, refsDir), 0755); err != nil {
+		return errors.Wrap(err, "mkdir refs")
+	}
+
+	layout := ispec.ImageLayout{Version: ispec.ImageLayoutVersion}
+	buf, err := json.Marshal(layout)
+	if err != nil {
+		return errors.Wrap(err, "marshal oci-layout")
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, layoutFile), buf, 0644); err != nil {
+		return errors.Wrap(err, "write oci-layout")
+	}
+	return nil
+}
+
+// Open opens an existing OCI image layout at path.
+func Open(path string, opts ...Option) (cas.Engine, error) {
+	if _, err := os.Stat(filepath.Join(path, layoutFile)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "check oci-layout")
+	}
+
+	engine := &Engine{
+		path:      path,
+		algorithm: cas.DefaultBlobAlgorithm,
+	}
+	for _, opt := range opts {
+		opt(engine)
+	}
+	if !cas.IsBlobAlgorithm(engine.algorithm) {
+		return nil, errors.Errorf("unsupported digest algorithm %q", engine.algorithm)
+	}
+	return engine, nil
+}
+
+func (e *Engine) blobPath(d digest.Digest) string {
+	return filepath.Join(e.path, blobsDir, d.Algorithm().String(), d.Encoded())
+}
+
+func (e *Engine) refPath(name string) string {
+	return filepath.Join(e.path, refsDir, name)
+}
+
+// PutBlob adds a new blob to the image, addressed with the Engine's
+// configured digest algorithm. See cas.Engine.
+func (e *Engine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "buffer blob")
+	}
+	dgst := e.algorithm.FromBytes(buf)
+
+	path := e.blobPath(dgst)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", -1, errors.Wrap(err, "mkdir blob algorithm directory")
+	}
+	if _, err := os.Stat(path); err == nil {
+		// Already stored; the read-only blob file is not rewritten.
+		return dgst, int64(len(buf)), nil
+	}
+	if err := ioutil.WriteFile(path, buf, 0444); err != nil {
+		return "", -1, errors.Wrap(err, "write blob")
+	}
+	return dgst, int64(len(buf)), nil
+}
+
+// PutBlobJSON adds a new JSON blob to the image. See cas.Engine.
+func (e *Engine) PutBlobJSON(ctx context.Context, data interface{}) (digest.Digest, int64, error) {
+	buf, err := cjson.Marshal(data)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "marshal blob")
+	}
+	return e.PutBlob(ctx, bytes.NewReader(buf))
+}
+
+// PutReference adds a new reference descriptor blob to the image. See
+// cas.Engine.
+func (e *Engine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	if existing, err := e.GetReference(ctx, name); err == nil {
+		if existing.Digest != descriptor.Digest || existing.MediaType != descriptor.MediaType {
+			return cas.ErrClobber
+		}
+		return nil
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return errors.Wrap(err, "check for existing reference")
+	}
+
+	buf, err := json.Marshal(descriptor)
+	if err != nil {
+		return errors.Wrap(err, "marshal reference")
+	}
+	if err := ioutil.WriteFile(e.refPath(name), buf, 0644); err != nil {
+		return errors.Wrap(err, "write reference")
+	}
+	return nil
+}
+
+// GetBlob returns a reader for retrieving a blob from the image. See
+// cas.Engine.
+func (e *Engine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	fh, err := os.Open(e.blobPath(digest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "open blob")
+	}
+	return fh, nil
+}
+
+// GetReference returns a reference from the image. See cas.Engine.
+func (e *Engine) GetReference(ctx context.Context, name string) (ispec.Descriptor, error) {
+	buf, err := ioutil.ReadFile(e.refPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ispec.Descriptor{}, err
+		}
+		return ispec.Descriptor{}, errors.Wrap(err, "read reference")
+	}
+	var descriptor ispec.Descriptor
+	if err := json.Unmarshal(buf, &descriptor); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "unmarshal reference")
+	}
+	return descriptor, nil
+}
+
+// DeleteBlob removes a blob from the image. See cas.Engine.
+func (e *Engine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	if err := os.Remove(e.blobPath(digest)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove blob")
+	}
+	return nil
+}
+
+// DeleteReference removes a reference from the image. See cas.Engine.
+func (e *Engine) DeleteReference(ctx context.Context, name string) error {
+	if err := os.Remove(e.refPath(name)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove reference")
+	}
+	return nil
+}
+
+// ListBlobs returns the set of blob digests stored in the image, across
+// every algorithm in cas.BlobAlgorithms. See cas.Engine.
+func (e *Engine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	var digests []digest.Digest
+	for _, algo := range cas.BlobAlgorithms {
+		entries, err := ioutil.ReadDir(filepath.Join(e.path, blobsDir, algo.String()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrap(err, "read blobs directory")
+		}
+		for _, entry := range entries {
+			digests = append(digests, digest.NewDigestFromEncoded(algo, entry.Name()))
+		}
+	}
+	return digests, nil
+}
+
+// ListReferences returns the set of reference names stored in the image.
+// See cas.Engine.
+func (e *Engine) ListReferences(ctx context.Context) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(e.path, refsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "read refs directory")
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// Clean executes a garbage collection of any non-blob garbage in the store.
+// The dir engine does not currently create any such garbage, so this is a
+// no-op.
+func (e *Engine) Clean(ctx context.Context) error {
+	return nil
+}
+
+// Close releases all references held by the engine.
+func (e *Engine) Close() error {
+	return nil
+}
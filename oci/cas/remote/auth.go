@@ -0,0 +1,249 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// authenticator resolves and caches the credentials required to talk to a
+// single registry host, handling both the Bearer token flow described by a
+// Www-Authenticate challenge and HTTP Basic auth sourced from a Docker- or
+// containers/image-style credential file.
+type authenticator struct {
+	host string
+
+	mu     sync.Mutex
+	scheme string // "bearer" or "basic", set once a challenge has been seen
+	token  string // cached bearer token
+	realm  string
+	params map[string]string
+}
+
+func newAuthenticator(host string) *authenticator {
+	return &authenticator{host: host}
+}
+
+// authenticate attaches whatever credentials have already been resolved (if
+// any) to the outgoing request. It is a no-op the first time a host is
+// contacted, since no challenge has been seen yet.
+func (a *authenticator) authenticate(client *http.Client, req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch a.scheme {
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	case "basic":
+		user, pass, ok := lookupBasicAuth(a.host)
+		if ok {
+			req.SetBasicAuth(user, pass)
+		}
+	}
+	return nil
+}
+
+// challenge parses the Www-Authenticate header of a 401 response and
+// resolves the credentials it describes, so that subsequent requests can be
+// authenticated. Supports the "Bearer" token flow (fetching a token from the
+// realm's token server) and falls back to "Basic" using locally configured
+// credentials.
+func (a *authenticator) challenge(client *http.Client, resp *http.Response, requestURL string) error {
+	header := resp.Header.Get("Www-Authenticate")
+	if header == "" {
+		return errors.New("missing Www-Authenticate header on 401 response")
+	}
+
+	scheme, params := parseChallenge(header)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		token, err := fetchBearerToken(client, a.host, params)
+		if err != nil {
+			return errors.Wrap(err, "fetch bearer token")
+		}
+		a.scheme = "bearer"
+		a.token = token
+	case "basic":
+		a.scheme = "basic"
+	default:
+		return errors.Errorf("unsupported auth scheme %q", scheme)
+	}
+
+	return nil
+}
+
+// fetchBearerToken requests a token from the realm named in the challenge
+// parameters, authenticating to the token server itself with any locally
+// configured basic auth credentials for the registry host.
+func fetchBearerToken(client *http.Client, host string, params map[string]string) (string, error) {
+	realm := params["realm"]
+	if realm == "" {
+		return "", errors.New("bearer challenge missing realm")
+	}
+
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", errors.Wrap(err, "parse realm")
+	}
+
+	q := u.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	if scope := params["scope"]; scope != "" {
+		q.Set("scope", scope)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "create token request")
+	}
+	if user, pass, ok := lookupBasicAuth(host); ok {
+		req.SetBasicAuth(user, pass)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "request token")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("token request: unexpected status %q", resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", errors.Wrap(err, "decode token response")
+	}
+
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// parseChallenge splits a Www-Authenticate header into its scheme (e.g.
+// "Bearer") and its key="value" parameters (e.g. realm, service, scope).
+func parseChallenge(header string) (scheme string, params map[string]string) {
+	params = map[string]string{}
+
+	fields := strings.SplitN(header, " ", 2)
+	scheme = fields[0]
+	if len(fields) != 2 {
+		return scheme, params
+	}
+
+	// Quoted values (such as scope="repository:foo:pull,push") may contain
+	// commas, so only a comma outside quotes ends a parameter.
+	rest := fields[1]
+	for {
+		kv := strings.SplitN(strings.TrimLeft(rest, " ,"), "=", 2)
+		if len(kv) != 2 {
+			break
+		}
+		key, value := strings.TrimSpace(kv[0]), kv[1]
+		end := strings.Index(value, ",")
+		if strings.HasPrefix(value, `"`) {
+			if end = strings.Index(value[1:], `"`); end >= 0 {
+				end += 2
+			}
+		}
+		if end < 0 {
+			end = len(value)
+		}
+		params[key] = strings.Trim(value[:end], `"`)
+		rest = value[end:]
+	}
+	return scheme, params
+}
+
+// dockerAuthConfig mirrors the relevant subset of ~/.docker/config.json and
+// $XDG_RUNTIME_DIR/containers/auth.json.
+type dockerAuthConfig struct {
+	Auths map[string]struct {
+		Auth string `json:"auth"`
+	} `json:"auths"`
+}
+
+// lookupBasicAuth resolves a username and password for the given registry
+// host from the first of the standard credential files that both exists and
+// contains an entry for the host.
+func lookupBasicAuth(host string) (user, pass string, ok bool) {
+	for _, path := range credentialFiles() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		var config dockerAuthConfig
+		if err := json.Unmarshal(data, &config); err != nil {
+			continue
+		}
+
+		entry, ok := config.Auths[host]
+		if !ok {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			continue
+		}
+
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		return parts[0], parts[1], true
+	}
+
+	return "", "", false
+}
+
+// credentialFiles returns the standard locations searched for registry
+// credentials, in priority order.
+func credentialFiles() []string {
+	var paths []string
+
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		paths = append(paths, filepath.Join(runtimeDir, "containers", "auth.json"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".docker", "config.json"))
+	}
+
+	return paths
+}
@@ -0,0 +1,66 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// splitRef splits a registry reference of the form
+// "<host>[:<port>]/<repository>" into its host and repository components.
+func splitRef(ref string) (host, repository string, err error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("invalid registry reference %q: expected <host>/<repository>", ref)
+	}
+	return parts[0], parts[1], nil
+}
+
+// parseNextLink extracts the "next" relation URL from an RFC 5988 Link
+// header, as returned by GET /v2/<name>/tags/list when pagination is in
+// effect. Returns the empty string if there is no next page.
+func parseNextLink(header string, base *url.URL) string {
+	if header == "" {
+		return ""
+	}
+
+	for _, link := range strings.Split(header, ",") {
+		segments := strings.Split(link, ";")
+		if len(segments) < 2 {
+			continue
+		}
+		if !strings.Contains(segments[1], `rel="next"`) {
+			continue
+		}
+
+		raw := strings.TrimSpace(segments[0])
+		raw = strings.TrimPrefix(raw, "<")
+		raw = strings.TrimSuffix(raw, ">")
+
+		next, err := url.Parse(raw)
+		if err != nil {
+			return ""
+		}
+		return base.ResolveReference(next).String()
+	}
+
+	return ""
+}
@@ -0,0 +1,484 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package remote implements a cas.Engine backed by an OCI Distribution Spec
+// v2 registry, using the same push/pull conventions as ORAS (OCI Registry As
+// Storage). It allows umoci to act as a self-contained round-tripper to a
+// registry without needing an external tool such as skopeo.
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/cjson"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Engine is a cas.Engine that talks to a remote OCI Distribution Spec v2
+// registry. All blob and reference operations are translated into the
+// appropriate HTTP requests against the registry's /v2/ API.
+type Engine struct {
+	client     *http.Client
+	baseURL    *url.URL
+	repository string
+	auth       *authenticator
+	algorithm  digest.Algorithm
+}
+
+// Option configures an optional behaviour of an Engine returned by Open.
+type Option func(*Engine)
+
+// WithAlgorithm sets the digest algorithm (one of cas.BlobAlgorithms) used
+// to address new blobs written through PutBlob and PutBlobJSON. If not
+// given, Open defaults to cas.DefaultBlobAlgorithm.
+func WithAlgorithm(algorithm digest.Algorithm) Option {
+	return func(e *Engine) { e.algorithm = algorithm }
+}
+
+// Open creates a new remote CAS engine rooted at the given registry
+// reference, of the form "<host>[:<port>]/<repository>". Authentication is
+// resolved lazily, the first time a request receives a 401 Unauthorized
+// challenge.
+func Open(ref string, opts ...Option) (cas.Engine, error) {
+	host, repository, err := splitRef(ref)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse registry reference")
+	}
+
+	baseURL := &url.URL{Scheme: "https", Host: host}
+	engine := &Engine{
+		client:     &http.Client{},
+		baseURL:    baseURL,
+		repository: repository,
+		auth:       newAuthenticator(host),
+		algorithm:  cas.DefaultBlobAlgorithm,
+	}
+	for _, opt := range opts {
+		opt(engine)
+	}
+	if !cas.IsBlobAlgorithm(engine.algorithm) {
+		return nil, errors.Errorf("unsupported digest algorithm %q", engine.algorithm)
+	}
+	return engine, nil
+}
+
+// url returns the absolute URL for the given /v2/ API path.
+func (e *Engine) url(format string, args ...interface{}) string {
+	u := *e.baseURL
+	u.Path = path.Join("/v2", e.repository, fmt.Sprintf(format, args...))
+	return u.String()
+}
+
+// uploadsURL returns the absolute URL used to initiate a blob upload
+// session. Unlike url(), it must NOT be built with path.Join: the
+// distribution-spec route is "/v2/<name>/blobs/uploads/" with a mandatory
+// trailing slash, which path.Join (via path.Clean) would strip, causing
+// registries to 404 the POST.
+func (e *Engine) uploadsURL() string {
+	u := *e.baseURL
+	u.Path = path.Join("/v2", e.repository) + "/blobs/uploads/"
+	return u.String()
+}
+
+// do executes the given request, transparently handling the Bearer or Basic
+// challenge described by a Www-Authenticate header on a first 401 response.
+func (e *Engine) do(req *http.Request) (*http.Response, error) {
+	if err := e.auth.authenticate(e.client, req); err != nil {
+		return nil, errors.Wrap(err, "authenticate request")
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "do request")
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+
+		if err := e.auth.challenge(e.client, resp, req.URL.String()); err != nil {
+			return nil, errors.Wrap(err, "handle auth challenge")
+		}
+
+		// Replay the original body on retry -- req.Body has already been
+		// drained by the failed attempt above, so re-creating it from
+		// GetBody (rather than clearing it) is required for any request
+		// that carries a payload (PATCHing blob content, PUTting a
+		// manifest), or the retry silently uploads an empty body.
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return nil, errors.New("cannot retry request after auth challenge: request body is not replayable")
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, errors.Wrap(err, "rewind request body for retry")
+			}
+			req.Body = body
+		}
+
+		if err := e.auth.authenticate(e.client, req); err != nil {
+			return nil, errors.Wrap(err, "re-authenticate request")
+		}
+		return e.client.Do(req)
+	}
+
+	return resp, nil
+}
+
+// PutBlob adds a new blob to the registry using a chunked upload session:
+// POST to obtain an upload location, PATCH the content, then PUT with the
+// final digest to complete the upload. This is idempotent -- if the blob
+// already exists the registry will short-circuit the upload.
+func (e *Engine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "buffer blob")
+	}
+	dgst := e.algorithm.FromBytes(buf)
+
+	req, err := http.NewRequest(http.MethodPost, e.uploadsURL(), nil)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "create upload session")
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := e.do(req)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "start blob upload")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return "", -1, errors.Errorf("start blob upload: unexpected status %q", resp.Status)
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", -1, errors.New("start blob upload: missing Location header")
+	}
+
+	patchReq, err := http.NewRequest(http.MethodPatch, location, bytes.NewReader(buf))
+	if err != nil {
+		return "", -1, errors.Wrap(err, "create patch request")
+	}
+	patchReq = patchReq.WithContext(ctx)
+	patchReq.Header.Set("Content-Type", "application/octet-stream")
+
+	patchResp, err := e.do(patchReq)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "patch blob content")
+	}
+	defer patchResp.Body.Close()
+
+	if patchResp.StatusCode != http.StatusAccepted {
+		return "", -1, errors.Errorf("patch blob content: unexpected status %q", patchResp.Status)
+	}
+
+	putLocation := patchResp.Header.Get("Location")
+	if putLocation == "" {
+		putLocation = location
+	}
+
+	putURL, err := url.Parse(putLocation)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "parse put location")
+	}
+	q := putURL.Query()
+	q.Set("digest", dgst.String())
+	putURL.RawQuery = q.Encode()
+
+	putReq, err := http.NewRequest(http.MethodPut, putURL.String(), nil)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "create finalise request")
+	}
+	putReq = putReq.WithContext(ctx)
+
+	putResp, err := e.do(putReq)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "finalise blob upload")
+	}
+	defer putResp.Body.Close()
+
+	if putResp.StatusCode != http.StatusCreated {
+		return "", -1, errors.Errorf("finalise blob upload: unexpected status %q", putResp.Status)
+	}
+
+	log.WithFields(log.Fields{
+		"digest": dgst,
+		"size":   len(buf),
+	}).Debugf("remote: pushed blob")
+
+	return dgst, int64(len(buf)), nil
+}
+
+// PutBlobJSON adds a new JSON blob to the registry. See cas.Engine.
+func (e *Engine) PutBlobJSON(ctx context.Context, data interface{}) (digest.Digest, int64, error) {
+	buf, err := cjson.Marshal(data)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "marshal blob")
+	}
+	return e.PutBlob(ctx, bytes.NewReader(buf))
+}
+
+// PutReference fetches the manifest content named by descriptor from the
+// registry's blob store (via GetBlob) and PUTs it to
+// /v2/<repository>/manifests/<name>, using the descriptor's MediaType as the
+// Content-Type of the request.
+func (e *Engine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	blob, err := e.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return errors.Wrap(err, "fetch manifest blob to push")
+	}
+	buf, err := ioutil.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return errors.Wrap(err, "read manifest blob to push")
+	}
+
+	// Buffering into a bytes.Reader (rather than passing the GetBlob stream
+	// straight through) means http.NewRequest populates req.GetBody for us,
+	// so do() can replay the body if the PUT has to be retried after a 401.
+	req, err := http.NewRequest(http.MethodPut, e.url("/manifests/%s", name), bytes.NewReader(buf))
+	if err != nil {
+		return errors.Wrap(err, "create manifest request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", descriptor.MediaType)
+
+	resp, err := e.do(req)
+	if err != nil {
+		return errors.Wrap(err, "put manifest")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return errors.Errorf("put manifest: unexpected status %q", resp.Status)
+	}
+	return nil
+}
+
+// GetBlob streams the blob with the given digest from
+// /v2/<name>/blobs/<digest>. The caller must Close() the returned reader.
+func (e *Engine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, e.url("/blobs/%s", digest), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create blob request")
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := e.do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "get blob")
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	default:
+		resp.Body.Close()
+		return nil, errors.Errorf("get blob: unexpected status %q", resp.Status)
+	}
+}
+
+// GetReference fetches the manifest descriptor named "name" from the
+// registry, resolving its media type and digest from the response headers.
+func (e *Engine) GetReference(ctx context.Context, name string) (ispec.Descriptor, error) {
+	req, err := http.NewRequest(http.MethodGet, e.url("/manifests/%s", name), nil)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "create manifest request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", ispec.MediaTypeImageManifest+", "+ispec.MediaTypeImageIndex)
+
+	resp, err := e.do(req)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get manifest")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ispec.Descriptor{}, os.ErrNotExist
+	default:
+		return ispec.Descriptor{}, errors.Errorf("get manifest: unexpected status %q", resp.Status)
+	}
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "read manifest body")
+	}
+
+	// Prefer the registry-reported digest (it reflects exactly the bytes
+	// the registry has stored, regardless of which algorithm it used), and
+	// only fall back to computing it ourselves if the header is missing.
+	dgst, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+	if err != nil {
+		dgst = e.algorithm.FromBytes(buf)
+	}
+
+	return ispec.Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    dgst,
+		Size:      int64(len(buf)),
+	}, nil
+}
+
+// GetManifest streams the raw manifest or index content stored at digest
+// from /v2/<name>/manifests/<digest>. Unlike GetBlob, which only reaches
+// content registered through the blob-upload path, this is the only way to
+// retrieve manifest content from a registry -- the distribution spec never
+// serves a manifest from the blobs endpoint, even though it is addressed by
+// the same digest. The caller must Close() the returned reader.
+func (e *Engine) GetManifest(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, e.url("/manifests/%s", digest), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create manifest request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", ispec.MediaTypeImageManifest+", "+ispec.MediaTypeImageIndex)
+
+	resp, err := e.do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "get manifest")
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	default:
+		resp.Body.Close()
+		return nil, errors.Errorf("get manifest: unexpected status %q", resp.Status)
+	}
+}
+
+// DeleteBlob removes a blob from the registry.
+func (e *Engine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	req, err := http.NewRequest(http.MethodDelete, e.url("/blobs/%s", digest), nil)
+	if err != nil {
+		return errors.Wrap(err, "create delete request")
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := e.do(req)
+	if err != nil {
+		return errors.Wrap(err, "delete blob")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNotFound {
+		return errors.Errorf("delete blob: unexpected status %q", resp.Status)
+	}
+	return nil
+}
+
+// DeleteReference removes a tag from the registry.
+func (e *Engine) DeleteReference(ctx context.Context, name string) error {
+	req, err := http.NewRequest(http.MethodDelete, e.url("/manifests/%s", name), nil)
+	if err != nil {
+		return errors.Wrap(err, "create delete request")
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := e.do(req)
+	if err != nil {
+		return errors.Wrap(err, "delete manifest")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNotFound {
+		return errors.Errorf("delete manifest: unexpected status %q", resp.Status)
+	}
+	return nil
+}
+
+// ListBlobs is not supported by the Distribution Spec v2 API (there is no
+// registry-wide blob listing endpoint), and always returns
+// cas.ErrNotImplemented.
+func (e *Engine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	return nil, cas.ErrNotImplemented
+}
+
+// ListReferences paginates /v2/<name>/tags/list, following the Link header
+// until the registry reports no further pages, and returns the full set of
+// tags known for the repository.
+func (e *Engine) ListReferences(ctx context.Context) ([]string, error) {
+	var tags []string
+
+	next := e.url("/tags/list")
+	for next != "" {
+		req, err := http.NewRequest(http.MethodGet, next, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "create tags list request")
+		}
+		req = req.WithContext(ctx)
+
+		resp, err := e.do(req)
+		if err != nil {
+			return nil, errors.Wrap(err, "list tags")
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.Errorf("list tags: unexpected status %q", resp.Status)
+		}
+
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "decode tags list")
+		}
+		tags = append(tags, page.Tags...)
+
+		next = parseNextLink(resp.Header.Get("Link"), e.baseURL)
+	}
+
+	return tags, nil
+}
+
+// Clean is a no-op for the remote engine -- garbage collection of a
+// registry's storage is the registry's responsibility, not the client's.
+func (e *Engine) Clean(ctx context.Context) error {
+	return nil
+}
+
+// Close releases the underlying HTTP client's idle connections.
+func (e *Engine) Close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Compression identifies the codec used to compress a layer diff tar.
+type Compression string
+
+// The set of compression codecs that umoci can produce and consume for
+// layer diffs. DiffIDs are always computed over the *uncompressed* tar
+// stream, regardless of which of these is selected -- only the blob stored
+// in the CAS (and its descriptor's mediatype) differs.
+const (
+	// GzipCompression produces application/vnd.oci.image.layer.v1.tar+gzip.
+	GzipCompression Compression = "gzip"
+	// ZstdCompression produces application/vnd.oci.image.layer.v1.tar+zstd.
+	ZstdCompression Compression = "zstd"
+	// NoneCompression produces application/vnd.oci.image.layer.v1.tar, with
+	// no compression at all.
+	NoneCompression Compression = "none"
+)
+
+// MediaType returns the OCI image-spec layer mediatype that corresponds to
+// c.
+func (c Compression) MediaType() (string, error) {
+	switch c {
+	case GzipCompression:
+		return ispec.MediaTypeImageLayerGzip, nil
+	case ZstdCompression:
+		return ispec.MediaTypeImageLayerZstd, nil
+	case NoneCompression:
+		return ispec.MediaTypeImageLayer, nil
+	default:
+		return "", errors.Errorf("unknown compression %q", c)
+	}
+}
+
+// Compress returns a reader which produces the result of compressing
+// everything read from uncompressed using c. The returned reader must be
+// read to completion (or closed, if it implements io.Closer) to avoid
+// leaking the goroutine that drives the compressor.
+func (c Compression) Compress(uncompressed io.Reader) (io.Reader, error) {
+	switch c {
+	case GzipCompression:
+		return pipeThrough(uncompressed, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }), nil
+	case ZstdCompression:
+		return pipeThrough(uncompressed, func(w io.Writer) io.WriteCloser {
+			zw, err := zstd.NewWriter(w)
+			if err != nil {
+				// zstd.NewWriter only fails on bad options, none of which
+				// we set, so this is unreachable in practice.
+				panic(err)
+			}
+			return zw
+		}), nil
+	case NoneCompression:
+		return uncompressed, nil
+	default:
+		return nil, errors.Errorf("unknown compression %q", c)
+	}
+}
+
+// pipeThrough streams src through the writer returned by newWriter,
+// asynchronously, returning a reader for the result. This lets a
+// Write-oriented compressor (gzip.Writer, zstd.Encoder) be exposed with the
+// Reader-oriented interface the rest of umoci's blob-writing path expects.
+func pipeThrough(src io.Reader, newWriter func(io.Writer) io.WriteCloser) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		w := newWriter(pw)
+		if _, err := io.Copy(w, src); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if err := w.Close(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+// Decompress returns a reader for the uncompressed contents of compressed,
+// dispatching to the correct decompressor for mediaType (one of the layer
+// mediatypes that MediaType() can produce). The caller must Close() the
+// returned reader -- for zstd in particular, this is required to release
+// the decoder's internal goroutine and buffers, not merely to close
+// compressed (which Decompress does not take ownership of; closing the
+// returned reader never closes compressed itself).
+func Decompress(mediaType string, compressed io.Reader) (io.ReadCloser, error) {
+	switch mediaType {
+	case ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerGzip + "+encrypted":
+		return gzip.NewReader(compressed)
+	case ispec.MediaTypeImageLayerZstd, ispec.MediaTypeImageLayerZstd + "+encrypted":
+		decoder, err := zstd.NewReader(compressed)
+		if err != nil {
+			return nil, errors.Wrap(err, "create zstd decoder")
+		}
+		return decoder.IOReadCloser(), nil
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayer + "+encrypted":
+		return ioutil.NopCloser(compressed), nil
+	default:
+		return nil, errors.Errorf("unknown layer mediatype %q", mediaType)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompressDecompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("umoci layer compression round-trip test data "), 4096)
+
+	for _, compression := range []Compression{GzipCompression, ZstdCompression, NoneCompression} {
+		t.Run(string(compression), func(t *testing.T) {
+			mediaType, err := compression.MediaType()
+			if err != nil {
+				t.Fatalf("MediaType: %v", err)
+			}
+
+			compressed, err := compression.Compress(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Compress: %v", err)
+			}
+
+			uncompressed, err := Decompress(mediaType, compressed)
+			if err != nil {
+				t.Fatalf("Decompress: %v", err)
+			}
+			defer uncompressed.Close()
+
+			got, err := ioutil.ReadAll(uncompressed)
+			if err != nil {
+				t.Fatalf("read decompressed data: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("decompressed data does not match original")
+			}
+		})
+	}
+}
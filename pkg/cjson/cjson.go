@@ -0,0 +1,131 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package cjson implements a canonical JSON marshaller. Go's encoding/json
+// already produces a stable byte-for-byte encoding for any given
+// interface{} value *except* for map[string]... types, whose key order is
+// deliberately randomised by the runtime to stop callers relying on it. That
+// randomisation means that marshalling the exact same logical document
+// twice (for instance, an ispec.Manifest with an Annotations map) can
+// produce two different blobs, which defeats content-addressed storage.
+//
+// Marshal works around this by round-tripping the value through
+// interface{}, walking the result, and re-marshalling every object with its
+// keys sorted lexicographically, so that two calls with equal input always
+// produce identical output.
+package cjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Marshal returns the canonical JSON encoding of v: object keys are sorted
+// lexicographically at every nesting level, with no insignificant
+// whitespace, so that two calls with logically equal input always produce
+// byte-identical output.
+func Marshal(v interface{}) ([]byte, error) {
+	// Round-trip through interface{} so that we have a generic tree we can
+	// walk and re-order, regardless of the concrete type of v.
+	naive, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal value")
+	}
+
+	// UseNumber() is required here: the default decoding of a JSON number
+	// into interface{} is float64, which cannot represent every int64 (for
+	// instance a Descriptor.Size above 2^53) exactly. Losing that precision
+	// would make the canonical bytes -- and therefore the digest -- diverge
+	// from the logical document.
+	var tree interface{}
+	decoder := json.NewDecoder(bytes.NewReader(naive))
+	decoder.UseNumber()
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, errors.Wrap(err, "unmarshal value into tree")
+	}
+
+	var buffer bytes.Buffer
+	if err := encode(&buffer, tree); err != nil {
+		return nil, errors.Wrap(err, "encode canonical tree")
+	}
+	return buffer.Bytes(), nil
+}
+
+// encode writes the canonical encoding of node to buffer.
+func encode(buffer *bytes.Buffer, node interface{}) error {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		return encodeObject(buffer, value)
+	case []interface{}:
+		return encodeArray(buffer, value)
+	default:
+		// Numbers, strings, bools and null have no ordering ambiguity, so
+		// we can rely on encoding/json to produce a stable representation
+		// (numbers arrive as json.Number, see Marshal, and are emitted as
+		// the same digits they were decoded from; strings are escaped
+		// identically on every call).
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return errors.Wrap(err, "marshal scalar")
+		}
+		_, err = buffer.Write(encoded)
+		return err
+	}
+}
+
+func encodeObject(buffer *bytes.Buffer, object map[string]interface{}) error {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buffer.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		keyEncoded, err := json.Marshal(key)
+		if err != nil {
+			return errors.Wrap(err, "marshal key")
+		}
+		buffer.Write(keyEncoded)
+		buffer.WriteByte(':')
+		if err := encode(buffer, object[key]); err != nil {
+			return err
+		}
+	}
+	buffer.WriteByte('}')
+	return nil
+}
+
+func encodeArray(buffer *bytes.Buffer, array []interface{}) error {
+	buffer.WriteByte('[')
+	for i, element := range array {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		if err := encode(buffer, element); err != nil {
+			return err
+		}
+	}
+	buffer.WriteByte(']')
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cjson
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMarshalSortsKeys(t *testing.T) {
+	a := map[string]int{"b": 2, "a": 1, "c": 3}
+	b := map[string]int{"c": 3, "b": 2, "a": 1}
+
+	encodedA, err := Marshal(a)
+	if err != nil {
+		t.Fatalf("marshal a: %v", err)
+	}
+	encodedB, err := Marshal(b)
+	if err != nil {
+		t.Fatalf("marshal b: %v", err)
+	}
+
+	if string(encodedA) != string(encodedB) {
+		t.Fatalf("marshal of equal maps produced different bytes: %q != %q", encodedA, encodedB)
+	}
+	if string(encodedA) != `{"a":1,"b":2,"c":3}` {
+		t.Fatalf("unexpected canonical encoding: %q", encodedA)
+	}
+}
+
+func TestMarshalPreservesLargeIntegerPrecision(t *testing.T) {
+	// 2^60, chosen because it is well outside the range float64 can
+	// represent exactly (above 2^53), so a naive round-trip through
+	// interface{} (which decodes numbers as float64) would corrupt it.
+	const want = 1152921504606846976
+
+	type payload struct {
+		Size int64 `json:"size"`
+	}
+
+	encoded, err := Marshal(payload{Size: want})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	var decoded payload
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if decoded.Size != want {
+		t.Fatalf("size precision lost: got %d, want %d", decoded.Size, want)
+	}
+}
@@ -0,0 +1,341 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package encryption implements opt-in layer encryption, following the
+// wrap-a-per-layer-data-key pattern that containers/ocicrypt uses for the
+// "...+encrypted" layer mediatypes: the layer itself is encrypted with a
+// randomly generated AES-256-GCM data key, and that data key is in turn
+// wrapped (via RSA-OAEP) to each recipient's public key, so that only
+// holders of the matching private key can recover it.
+//
+// The wrapped keys and the options needed to unwrap them are not stored in
+// the layer itself -- they travel alongside it as descriptor annotations
+// (AnnotationKeys / AnnotationPubopts), mirroring how containers/ocicrypt
+// keeps key material out of the CAS-addressed blob.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// chunkSize is the amount of plaintext sealed into each AEAD chunk by
+// encryptStream/decryptStream. Layers are encrypted and decrypted one chunk
+// at a time (rather than being buffered into memory in full) so that
+// EncryptLayer and DecryptLayer can stream arbitrarily large layers.
+const chunkSize = 1 << 20 // 1MiB
+
+const (
+	// AnnotationKeyPrefix is the prefix of the per-recipient annotation
+	// keys added to an encrypted layer's descriptor, each holding one
+	// recipient's wrapped data key.
+	AnnotationKeyPrefix = "org.opencontainers.image.enc.keys."
+
+	// AnnotationPubopts is the annotation holding the encoded options
+	// (cipher and nonce) needed to unwrap and decrypt the layer once a
+	// recipient's wrapped key has been recovered.
+	AnnotationPubopts = "org.opencontainers.image.enc.pubopts"
+)
+
+// pubopts is the structure stored (base64-encoded) in AnnotationPubopts.
+type pubopts struct {
+	Cipher string `json:"cipher"`
+	Nonce  []byte `json:"nonce"`
+}
+
+// Recipient is a single encryption recipient, identified by the path to
+// their public key (PEM-encoded PKIX RSA). JWE, PGP and PKCS7 recipients
+// are all expected to eventually resolve to a PEM-encoded public key by the
+// caller before being passed here.
+type Recipient struct {
+	// Name is an opaque identifier (e.g. the path or fingerprint the user
+	// passed via --recipient) used purely for error messages.
+	Name string
+	// PublicKey is the recipient's PEM-encoded RSA public key.
+	PublicKey []byte
+}
+
+// EncryptLayer encrypts the (uncompressed-or-compressed, opaque to this
+// package) layer stream read from plain with a freshly generated AES-256-GCM
+// data key, wraps that data key to every given recipient, and returns the
+// ciphertext reader along with the annotations that must be attached to the
+// layer's descriptor so that DecryptLayer can later recover it.
+func EncryptLayer(plain io.Reader, recipients []Recipient) (io.Reader, map[string]string, error) {
+	if len(recipients) == 0 {
+		return nil, nil, errors.New("encrypt layer: at least one recipient is required")
+	}
+
+	key := make([]byte, 32) // AES-256
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, errors.Wrap(err, "generate data key")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create aes cipher")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create gcm")
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, errors.Wrap(err, "generate nonce")
+	}
+
+	annotations := map[string]string{}
+	for i, recipient := range recipients {
+		wrapped, err := wrapKey(key, recipient.PublicKey)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "wrap data key for recipient %q", recipient.Name)
+		}
+		annotations[fmt.Sprintf("%s%d", AnnotationKeyPrefix, i)] = base64.StdEncoding.EncodeToString(wrapped)
+	}
+
+	opts, err := json.Marshal(pubopts{Cipher: "AES-256-GCM", Nonce: nonce})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "marshal pubopts")
+	}
+	annotations[AnnotationPubopts] = base64.StdEncoding.EncodeToString(opts)
+
+	return encryptStream(plain, gcm, nonce), annotations, nil
+}
+
+// DecryptLayer reverses EncryptLayer: it tries privateKey against every
+// wrapped data key recorded in annotations until one unwraps successfully,
+// then uses the recovered key (and the nonce recorded in AnnotationPubopts)
+// to decrypt cipherReader. If privateKey does not correspond to any of the
+// recipients the layer was encrypted for, it returns an error explaining
+// that clearly rather than a raw crypto failure.
+func DecryptLayer(cipherReader io.Reader, annotations map[string]string, privateKey []byte) (io.Reader, error) {
+	encodedOpts, ok := annotations[AnnotationPubopts]
+	if !ok {
+		return nil, errors.Errorf("layer is missing required %q annotation", AnnotationPubopts)
+	}
+	rawOpts, err := base64.StdEncoding.DecodeString(encodedOpts)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode pubopts")
+	}
+	var opts pubopts
+	if err := json.Unmarshal(rawOpts, &opts); err != nil {
+		return nil, errors.Wrap(err, "unmarshal pubopts")
+	}
+
+	key, err := unwrapAnyKey(annotations, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "create aes cipher")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "create gcm")
+	}
+
+	return decryptStream(cipherReader, gcm, opts.Nonce), nil
+}
+
+// encryptStream seals plain into a sequence of independently-decryptable
+// chunks, each AEAD-sealed with a nonce derived from base and the chunk's
+// index, and writes them (each length-prefixed so decryptStream knows where
+// one ends and the next begins) to the returned reader as they are
+// produced.
+func encryptStream(plain io.Reader, gcm cipher.AEAD, base []byte) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		buf := make([]byte, chunkSize)
+		var counter uint64
+		for {
+			n, err := io.ReadFull(plain, buf)
+			if n > 0 {
+				sealed := gcm.Seal(nil, chunkNonce(base, counter), buf[:n], nil)
+				counter++
+
+				var length [4]byte
+				binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+				if _, werr := pw.Write(length[:]); werr != nil {
+					pw.CloseWithError(werr)
+					return
+				}
+				if _, werr := pw.Write(sealed); werr != nil {
+					pw.CloseWithError(werr)
+					return
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(errors.Wrap(err, "read layer"))
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+// decryptStream reverses encryptStream, reading and opening each
+// length-prefixed chunk from cipherReader in turn.
+func decryptStream(cipherReader io.Reader, gcm cipher.AEAD, base []byte) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		var counter uint64
+		for {
+			var length [4]byte
+			if _, err := io.ReadFull(cipherReader, length[:]); err != nil {
+				if err == io.EOF {
+					break
+				}
+				pw.CloseWithError(errors.Wrap(err, "read encrypted layer chunk length"))
+				return
+			}
+
+			sealed := make([]byte, binary.BigEndian.Uint32(length[:]))
+			if _, err := io.ReadFull(cipherReader, sealed); err != nil {
+				pw.CloseWithError(errors.Wrap(err, "read encrypted layer chunk"))
+				return
+			}
+
+			plaintext, err := gcm.Open(nil, chunkNonce(base, counter), sealed, nil)
+			if err != nil {
+				pw.CloseWithError(errors.Wrap(err, "decrypt layer: authentication failed"))
+				return
+			}
+			counter++
+
+			if _, err := pw.Write(plaintext); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+// chunkNonce derives the nonce used to seal/open the counter'th chunk from
+// base (the nonce generated once per layer) by XORing counter, big-endian,
+// into its low-order bytes. Each chunk therefore gets a distinct nonce
+// without needing to generate or transmit one separately.
+func chunkNonce(base []byte, counter uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+
+	var encodedCounter [8]byte
+	binary.BigEndian.PutUint64(encodedCounter[:], counter)
+
+	offset := len(nonce) - len(encodedCounter)
+	for i, b := range encodedCounter {
+		nonce[offset+i] ^= b
+	}
+	return nonce
+}
+
+// unwrapAnyKey tries privateKey against every recipient's wrapped key
+// recorded in annotations, returning the first one that unwraps
+// successfully.
+func unwrapAnyKey(annotations map[string]string, privateKey []byte) ([]byte, error) {
+	der, _ := pem.Decode(privateKey)
+	if der == nil {
+		return nil, errors.New("decode recipient private key: not PEM encoded")
+	}
+	key, err := parseRSAPrivateKey(der.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse recipient private key")
+	}
+
+	var lastErr error
+	for name, value := range annotations {
+		if len(name) <= len(AnnotationKeyPrefix) || name[:len(AnnotationKeyPrefix)] != AnnotationKeyPrefix {
+			continue
+		}
+
+		wrapped, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		dataKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, wrapped, nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return dataKey, nil
+	}
+
+	if lastErr == nil {
+		return nil, errors.New("layer is not encrypted for the given recipient key: no wrapped keys found")
+	}
+	return nil, errors.Wrap(lastErr, "layer is not encrypted for the given recipient key")
+}
+
+// parseRSAPrivateKey parses a DER-encoded RSA private key, accepting both
+// the PKCS1 form ("RSA PRIVATE KEY", as produced by e.g. "openssl genrsa")
+// and the PKCS8 form ("PRIVATE KEY", as produced by e.g. "openssl genpkey"),
+// since --key's help only promises a "PEM-encoded private key" without
+// specifying which ASN.1 encoding it uses.
+func parseRSAPrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, errors.New("not a PKCS1 or PKCS8 RSA private key")
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("unsupported private key type %T (only RSA is supported)", parsed)
+	}
+	return key, nil
+}
+
+// wrapKey wraps key to recipientPublicKey (a PEM-encoded PKIX RSA public
+// key) using RSA-OAEP.
+func wrapKey(key, recipientPublicKey []byte) ([]byte, error) {
+	der, _ := pem.Decode(recipientPublicKey)
+	if der == nil {
+		return nil, errors.New("not PEM encoded")
+	}
+	pub, err := x509.ParsePKIXPublicKey(der.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse public key")
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("unsupported recipient public key type %T (only RSA is supported)", pub)
+	}
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPub, key, nil)
+}
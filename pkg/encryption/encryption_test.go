@@ -0,0 +1,115 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"testing"
+)
+
+func generateTestKeyPair(t *testing.T, pkcs8 bool) (public, private []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate rsa key: %v", err)
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal public key: %v", err)
+	}
+	public = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+
+	if pkcs8 {
+		privDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatalf("marshal pkcs8 private key: %v", err)
+		}
+		private = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+	} else {
+		private = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	}
+	return public, private
+}
+
+func testEncryptDecryptRoundTrip(t *testing.T, pkcs8 bool) {
+	t.Helper()
+
+	public, private := generateTestKeyPair(t, pkcs8)
+
+	// Large enough to span several chunkSize-sized AEAD chunks, so the
+	// streaming encrypt/decrypt path is actually exercised.
+	plaintext := bytes.Repeat([]byte("umoci layer encryption round-trip test data "), chunkSize/8)
+
+	ciphertextReader, annotations, err := EncryptLayer(bytes.NewReader(plaintext), []Recipient{{Name: "test", PublicKey: public}})
+	if err != nil {
+		t.Fatalf("EncryptLayer: %v", err)
+	}
+	ciphertext, err := ioutil.ReadAll(ciphertextReader)
+	if err != nil {
+		t.Fatalf("read ciphertext: %v", err)
+	}
+	if bytes.Contains(ciphertext, plaintext[:64]) {
+		t.Fatalf("ciphertext contains recognisable plaintext")
+	}
+
+	plaintextReader, err := DecryptLayer(bytes.NewReader(ciphertext), annotations, private)
+	if err != nil {
+		t.Fatalf("DecryptLayer: %v", err)
+	}
+	decrypted, err := ioutil.ReadAll(plaintextReader)
+	if err != nil {
+		t.Fatalf("read decrypted layer: %v", err)
+	}
+
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("decrypted layer does not match original plaintext")
+	}
+}
+
+func TestEncryptDecryptRoundTripPKCS1(t *testing.T) {
+	testEncryptDecryptRoundTrip(t, false)
+}
+
+func TestEncryptDecryptRoundTripPKCS8(t *testing.T) {
+	testEncryptDecryptRoundTrip(t, true)
+}
+
+func TestDecryptLayerWrongKeyFails(t *testing.T) {
+	public, _ := generateTestKeyPair(t, false)
+	_, otherPrivate := generateTestKeyPair(t, false)
+
+	ciphertextReader, annotations, err := EncryptLayer(bytes.NewReader([]byte("secret")), []Recipient{{Name: "test", PublicKey: public}})
+	if err != nil {
+		t.Fatalf("EncryptLayer: %v", err)
+	}
+	ciphertext, err := ioutil.ReadAll(ciphertextReader)
+	if err != nil {
+		t.Fatalf("read ciphertext: %v", err)
+	}
+
+	if _, err := DecryptLayer(bytes.NewReader(ciphertext), annotations, otherPrivate); err == nil {
+		t.Fatalf("DecryptLayer unexpectedly succeeded with the wrong private key")
+	}
+}